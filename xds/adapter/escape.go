@@ -16,6 +16,22 @@ limitations under the License.
 
 package adapter
 
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
 // Cookie, Header and Query Parameter escaping strategy. Whereas:
 // 1. Envoy has no direct support for cookies. Cookies can only be
 //    generated by appending "Set-Cookie" headers.
@@ -57,14 +73,23 @@ const (
 	cookieSafe
 	querySafe
 	regexSafe
+	pathSegmentSafe
+	htmlTextSafe
+	htmlAttrSafe
+	jsonStringSafe
 
-	safe flags = headerSafe | cookieSafe | querySafe | regexSafe
+	safe flags = headerSafe | cookieSafe | querySafe | regexSafe | pathSegmentSafe |
+		htmlTextSafe | htmlAttrSafe | jsonStringSafe
 )
 
-func (f flags) isHeaderSafe() bool { return f&headerSafe != 0 }
-func (f flags) isCookieSafe() bool { return f&cookieSafe != 0 }
-func (f flags) isQuerySafe() bool  { return f&querySafe != 0 }
-func (f flags) isRegexSafe() bool  { return f&regexSafe != 0 }
+func (f flags) isHeaderSafe() bool      { return f&headerSafe != 0 }
+func (f flags) isCookieSafe() bool      { return f&cookieSafe != 0 }
+func (f flags) isQuerySafe() bool       { return f&querySafe != 0 }
+func (f flags) isRegexSafe() bool       { return f&regexSafe != 0 }
+func (f flags) isPathSegmentSafe() bool { return f&pathSegmentSafe != 0 }
+func (f flags) isHTMLTextSafe() bool    { return f&htmlTextSafe != 0 }
+func (f flags) isHTMLAttrSafe() bool    { return f&htmlAttrSafe != 0 }
+func (f flags) isJSONStringSafe() bool  { return f&jsonStringSafe != 0 }
 
 var (
 	// byteFlags is initialized to a 256-element array containing one
@@ -113,6 +138,33 @@ func init() {
 		}
 	}
 
+	// pchar per https://tools.ietf.org/html/rfc3986#section-3.3 is
+	// unreserved / pct-encoded / sub-delims / ":" / "@". Everything
+	// else must be percent-encoded in a path segment. This is
+	// deliberately more permissive than querySafe: a path segment may
+	// contain sub-delimiters and ':'/'@' unescaped. It is also more
+	// permissive than net/url's PathEscape, which escapes the
+	// sub-delimiters '!', '\'', '(', ')', '*', ',' and ';'.
+	for b := 0; b < 0x100; b++ {
+		switch {
+		case b == '-' || b == '_' || b == '.' || b == '~':
+			// unreserved
+		case b >= 'A' && b <= 'Z':
+			// unreserved
+		case b >= 'a' && b <= 'z':
+			// unreserved
+		case b >= '0' && b <= '9':
+			// unreserved
+		case b == ':' || b == '@':
+			// pchar
+		case b == '!' || b == '$' || b == '&' || b == '\'' || b == '(' || b == ')' ||
+			b == '*' || b == '+' || b == ',' || b == ';' || b == '=':
+			// sub-delims
+		default:
+			byteFlags[b] &= ^pathSegmentSafe
+		}
+	}
+
 	// Regex characters that require escaping to be treated as
 	// literals.
 	for _, b := range []byte{
@@ -120,6 +172,32 @@ func init() {
 	} {
 		byteFlags[b] &= ^regexSafe
 	}
+
+	// Characters requiring escaping when interpolated into HTML text
+	// content.
+	for _, b := range []byte{'<', '>', '&'} {
+		byteFlags[b] &= ^htmlTextSafe
+	}
+
+	// Characters requiring escaping when interpolated into a quoted
+	// HTML attribute value. Strictly more restrictive than
+	// htmlTextSafe: quote characters must also be escaped, since either
+	// may delimit the attribute.
+	for _, b := range []byte{'<', '>', '&', '"', '\''} {
+		byteFlags[b] &= ^htmlAttrSafe
+	}
+
+	// Characters requiring escaping when interpolated into a JSON
+	// string per https://tools.ietf.org/html/rfc8259#section-7: all
+	// control characters, '"', '\\', and (for predictability in
+	// contexts that assume printable ASCII) DEL.
+	for b := 0; b < 0x20; b++ {
+		byteFlags[b] &= ^jsonStringSafe
+	}
+	byteFlags[0x7f] &= ^jsonStringSafe
+	for _, b := range []byte{'"', '\\'} {
+		byteFlags[b] &= ^jsonStringSafe
+	}
 }
 
 // regexMode is used to indicate what level of regex escaping is
@@ -145,6 +223,7 @@ const (
 	notEncoded encodingType = iota
 	percentEncoded
 	regexEncoded
+	textEncoded
 )
 
 // transformer takes a text input and performs a transformation based
@@ -163,10 +242,14 @@ type transformer struct {
 }
 
 var (
-	metadataEscaper = &transformer{metadataEscapeLen, metadataEscape, noEscape}
-	headerMatcher   = &transformer{headerMatcherLen, headerMatcherEscape, dynamicEscape}
-	cookieMatcher   = &transformer{cookieMatcherLen, cookieMatcherEscape, alwaysEscape}
-	queryMatcher    = &transformer{queryMatcherLen, queryMatcherEscape, noEscape}
+	metadataEscaper    = &transformer{metadataEscapeLen, metadataEscape, noEscape}
+	headerMatcher      = &transformer{headerMatcherLen, headerMatcherEscape, dynamicEscape}
+	cookieMatcher      = &transformer{cookieMatcherLen, cookieMatcherEscape, alwaysEscape}
+	queryMatcher       = &transformer{queryMatcherLen, queryMatcherEscape, noEscape}
+	pathSegmentMatcher = &transformer{pathSegmentMatcherLen, pathSegmentMatcherEscape, noEscape}
+	htmlTextEscaper    = &transformer{htmlTextEscapeLen, htmlTextEscape, noEscape}
+	htmlAttrEscaper    = &transformer{htmlAttrEscapeLen, htmlAttrEscape, noEscape}
+	jsonStringEscaper  = &transformer{jsonStringEscapeLen, jsonStringEscape, noEscape}
 )
 
 // Transforms the string and returns true if the output is a regular
@@ -177,27 +260,36 @@ func (t *transformer) transform(s string) (string, bool) {
 
 	bytes := []byte(s)
 
-	// Compute the output size.
+	// Compute the output size in a single pass. Under dynamicEscape, a
+	// byte that is safe except for being regex-unsafe (e.g. '.') is
+	// counted as 1 byte, since it wouldn't need escaping unless some
+	// other byte later in the string forces a regex to be emitted. If
+	// that happens, every such byte seen so far needs one extra byte
+	// for its backslash; pendingRegexEscapes tracks that count so the
+	// total can be corrected with a single addition instead of
+	// rescanning the bytes already processed.
 	resultBytes := 0
 	changed := false
-	for i := 0; i < len(bytes); {
-		n, encoding := t.len(bytes[i], mode)
-		if mode == dynamicEscape && encoding == regexEncoded {
-			// We've emitted a regex expression and must restart to
-			// insure that any previously un-escaped regex special
-			// characters are counted correctly.
-			mode = alwaysEscape
-			i = 0
-			resultBytes = 0
-			continue
+	pendingRegexEscapes := 0
+	for _, b := range bytes {
+		n, encoding := t.len(b, mode)
+
+		if mode == dynamicEscape {
+			if encoding == regexEncoded {
+				// We've emitted a regex expression: switch modes and
+				// fold in the extra byte owed by each previously-seen
+				// regex-unsafe byte, rather than restarting the scan.
+				mode = alwaysEscape
+				resultBytes += pendingRegexEscapes
+			} else if encoding == notEncoded && !byteFlags[b].isRegexSafe() {
+				pendingRegexEscapes++
+			}
 		}
 
 		resultBytes += n
 		if encoding != notEncoded {
 			changed = true
 		}
-
-		i++
 	}
 
 	// If nothing changed, we report the output as a regex only if the
@@ -383,6 +475,137 @@ func queryMatcherEscape(b byte, escapeRegex bool) []byte {
 	return []byte{b}
 }
 
+func pathSegmentMatcherLen(b byte, mode regexMode) (int, encodingType) {
+	if mode != noEscape {
+		panic("path segment matchers are never regexes")
+	}
+
+	if !byteFlags[b].isPathSegmentSafe() {
+		return 3, percentEncoded
+	}
+	return 1, notEncoded
+}
+
+func pathSegmentMatcherEscape(b byte, escapeRegex bool) []byte {
+	if escapeRegex {
+		panic("path segment matchers are never regexes")
+	}
+
+	if !byteFlags[b].isPathSegmentSafe() {
+		return []byte{'%', hex[b>>4], hex[b&0xF]}
+	}
+	return []byte{b}
+}
+
+// htmlEntityFor returns the named HTML entity for b, which must be one
+// of the characters excluded from htmlTextSafe or htmlAttrSafe.
+func htmlEntityFor(b byte) []byte {
+	switch b {
+	case '<':
+		return []byte("&lt;")
+	case '>':
+		return []byte("&gt;")
+	case '&':
+		return []byte("&amp;")
+	case '"':
+		return []byte("&quot;")
+	case '\'':
+		return []byte("&#39;")
+	default:
+		return []byte{b}
+	}
+}
+
+func htmlTextEscapeLen(b byte, mode regexMode) (int, encodingType) {
+	if mode != noEscape {
+		panic("HTML escaping does not support regex escaping")
+	}
+
+	if byteFlags[b].isHTMLTextSafe() {
+		return 1, notEncoded
+	}
+	return len(htmlEntityFor(b)), textEncoded
+}
+
+func htmlTextEscape(b byte, escapeRegex bool) []byte {
+	if escapeRegex {
+		panic("HTML escaping does not support regex escaping")
+	}
+
+	if byteFlags[b].isHTMLTextSafe() {
+		return []byte{b}
+	}
+	return htmlEntityFor(b)
+}
+
+func htmlAttrEscapeLen(b byte, mode regexMode) (int, encodingType) {
+	if mode != noEscape {
+		panic("HTML escaping does not support regex escaping")
+	}
+
+	if byteFlags[b].isHTMLAttrSafe() {
+		return 1, notEncoded
+	}
+	return len(htmlEntityFor(b)), textEncoded
+}
+
+func htmlAttrEscape(b byte, escapeRegex bool) []byte {
+	if escapeRegex {
+		panic("HTML escaping does not support regex escaping")
+	}
+
+	if byteFlags[b].isHTMLAttrSafe() {
+		return []byte{b}
+	}
+	return htmlEntityFor(b)
+}
+
+// jsonEscapeFor returns the JSON string escape sequence for b, which
+// must not be jsonStringSafe: the named two-character escapes defined
+// by RFC 8259 where one exists, otherwise a \u00XX escape.
+func jsonEscapeFor(b byte) []byte {
+	switch b {
+	case '"':
+		return []byte(`\"`)
+	case '\\':
+		return []byte(`\\`)
+	case '\n':
+		return []byte(`\n`)
+	case '\t':
+		return []byte(`\t`)
+	case '\r':
+		return []byte(`\r`)
+	case '\b':
+		return []byte(`\b`)
+	case '\f':
+		return []byte(`\f`)
+	default:
+		return []byte{'\\', 'u', '0', '0', hex[b>>4], hex[b&0xF]}
+	}
+}
+
+func jsonStringEscapeLen(b byte, mode regexMode) (int, encodingType) {
+	if mode != noEscape {
+		panic("JSON string escaping does not support regex escaping")
+	}
+
+	if byteFlags[b].isJSONStringSafe() {
+		return 1, notEncoded
+	}
+	return len(jsonEscapeFor(b)), textEncoded
+}
+
+func jsonStringEscape(b byte, escapeRegex bool) []byte {
+	if escapeRegex {
+		panic("JSON string escaping does not support regex escaping")
+	}
+
+	if byteFlags[b].isJSONStringSafe() {
+		return []byte{b}
+	}
+	return jsonEscapeFor(b)
+}
+
 // Escape the given string to be safe as a cookie value (which implies
 // safety as a header value). See
 // https://tools.ietf.org/html/rfc6265#section-4.1). Additionally,
@@ -413,4 +636,379 @@ func cookieMatcherForMetadata(value string) string {
 func queryMatcherForMetadata(value string) string {
 	escaped, _ := queryMatcher.transform(value)
 	return escaped
-}
\ No newline at end of file
+}
+
+// escapeMetadataForPathSegment escapes value for literal embedding in a
+// URL path segment, following the pchar grammar
+// (https://tools.ietf.org/html/rfc3986#section-3.3), which leaves
+// sub-delimiters and ':'/'@' unescaped. This is a separate pathway from
+// escapeMetadata: escapeMetadata's cookie-safe table additionally
+// escapes ',' and ';' (cookie-unsafe, but valid pchars), which would
+// over-escape metadata used to build a path. pathSegmentMatcherForMetadata
+// is this function's matcher counterpart, the way cookieMatcherForMetadata
+// is escapeMetadata's.
+func escapeMetadataForPathSegment(value string) string {
+	escaped, _ := pathSegmentMatcher.transform(value)
+	return escaped
+}
+
+// Produces a string literal suitable for matching escaped metadata in a
+// URL path segment in an Envoy path matcher. Matches the output of
+// escapeMetadataForPathSegment, not escapeMetadata: see that function's
+// doc comment for why path segments use their own escaping pathway.
+func pathSegmentMatcherForMetadata(value string) string {
+	escaped, _ := pathSegmentMatcher.transform(value)
+	return escaped
+}
+
+// Unicode-aware metadata escaping. byteFlags already treats every byte
+// >= 0x80 (which includes every byte of a multi-byte UTF-8 sequence)
+// as unsafe for headers, cookies and queries, so the existing per-byte
+// escapers already emit one %XX triplet per UTF-8 byte, matching
+// net/url.QueryEscape/PathEscape semantics. What they don't do is
+// reject malformed UTF-8, which would otherwise be escaped byte-for-byte
+// into meaningless output. The functions below add that validation in
+// front of the existing escapers/matchers.
+
+func invalidUTF8Error(value string) error {
+	return fmt.Errorf("adapter: metadata value %q is not valid UTF-8", value)
+}
+
+// escapeMetadataUnicode behaves like escapeMetadata, but first validates
+// that value is well-formed UTF-8, returning an error if it is not.
+func escapeMetadataUnicode(value string) (string, error) {
+	if !utf8.ValidString(value) {
+		return "", invalidUTF8Error(value)
+	}
+	return escapeMetadata(value), nil
+}
+
+// headerMatcherForMetadataUnicode behaves like headerMatcherForMetadata,
+// but first validates that value is well-formed UTF-8, returning an
+// error if it is not.
+func headerMatcherForMetadataUnicode(value string) (string, bool, error) {
+	if !utf8.ValidString(value) {
+		return "", false, invalidUTF8Error(value)
+	}
+	matched, isRegex := headerMatcherForMetadata(value)
+	return matched, isRegex, nil
+}
+
+// cookieMatcherForMetadataUnicode behaves like cookieMatcherForMetadata,
+// but first validates that value is well-formed UTF-8, returning an
+// error if it is not.
+func cookieMatcherForMetadataUnicode(value string) (string, error) {
+	if !utf8.ValidString(value) {
+		return "", invalidUTF8Error(value)
+	}
+	return cookieMatcherForMetadata(value), nil
+}
+
+// queryMatcherForMetadataUnicode behaves like queryMatcherForMetadata,
+// but first validates that value is well-formed UTF-8, returning an
+// error if it is not.
+func queryMatcherForMetadataUnicode(value string) (string, error) {
+	if !utf8.ValidString(value) {
+		return "", invalidUTF8Error(value)
+	}
+	return queryMatcherForMetadata(value), nil
+}
+
+// punycodeEncoder converts a Unicode hostname to its ASCII-compatible
+// (IDNA/punycode) form, e.g. golang.org/x/net/idna's Lookup.ToASCII or
+// Punycode.ToASCII. It is accepted as a hook rather than imported
+// directly so that callers who don't need host-aware escaping don't pay
+// for the dependency.
+type punycodeEncoder func(host string) (string, error)
+
+// escapeMetadataUnicodeHost escapes value for use as metadata known to
+// hold a hostname. If encode is non-nil, value is first converted to
+// its ASCII-compatible punycode form, so the escaped result is both
+// header-safe and meaningful for DNS/SNI matching rather than a string
+// of percent-encoded UTF-8 bytes. If encode is nil, this is equivalent
+// to escapeMetadataUnicode.
+func escapeMetadataUnicodeHost(value string, encode punycodeEncoder) (string, error) {
+	if encode == nil {
+		return escapeMetadataUnicode(value)
+	}
+
+	ascii, err := encode(value)
+	if err != nil {
+		return "", err
+	}
+
+	return escapeMetadata(ascii), nil
+}
+
+// SecureCodec authenticates, and optionally encrypts, metadata values
+// carried in cookies, in the style of gorilla/securecookie. A value
+// encoded with Encode is a '|'-joined token:
+//
+//	base64url(name) | unix-timestamp | base64url(value) | base64url(hmac)
+//
+// HashKeys and BlockKeys support key rotation: HashKeys[0] signs new
+// tokens, while every key in HashKeys is tried, in order, to verify
+// existing ones. If BlockKeys is non-empty, it must be the same length
+// as HashKeys: BlockKeys[i] encrypts/decrypts whenever HashKeys[i]
+// signs/verifies, so the two stay paired by rotation epoch. (AES-CTR
+// decryption can't detect a wrong key on its own the way HMAC
+// verification can, so epoch pairing is what makes trying multiple
+// keys safe.) This lets an operator introduce a new key pair, let old
+// tokens drain, then drop the old pair.
+type SecureCodec struct {
+	// Name binds an encoded token to the cookie it's stored in, so a
+	// token lifted from one cookie can't be replayed into another.
+	Name string
+
+	// HashKeys authenticate the token with HMAC-SHA256. Each key must
+	// be 32 or 64 bytes. At least one is required.
+	HashKeys [][]byte
+
+	// BlockKeys, if non-empty, additionally encrypt the value with
+	// AES-CTR. Each key must be 16, 24, or 32 bytes (AES-128/192/256),
+	// and len(BlockKeys) must equal len(HashKeys).
+	BlockKeys [][]byte
+
+	// MaxAge bounds how old a token may be before Decode rejects it.
+	// Zero disables the check.
+	MaxAge time.Duration
+}
+
+// validate checks that the codec's keys are present and correctly
+// sized before Encode/Decode use them.
+func (c *SecureCodec) validate() error {
+	if len(c.HashKeys) == 0 {
+		return errors.New("adapter: SecureCodec requires at least one hash key")
+	}
+	for _, key := range c.HashKeys {
+		if len(key) != 32 && len(key) != 64 {
+			return fmt.Errorf("adapter: SecureCodec hash key must be 32 or 64 bytes, got %d", len(key))
+		}
+	}
+	if len(c.BlockKeys) > 0 && len(c.BlockKeys) != len(c.HashKeys) {
+		return errors.New("adapter: SecureCodec BlockKeys must be the same length as HashKeys, paired by rotation epoch")
+	}
+	return nil
+}
+
+// encryptAESCTR encrypts plaintext with a random IV, which is prefixed
+// to the returned ciphertext.
+func encryptAESCTR(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, aes.BlockSize+len(plaintext))
+	iv := out[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	cipher.NewCTR(block, iv).XORKeyStream(out[aes.BlockSize:], plaintext)
+
+	return out, nil
+}
+
+// decryptAESCTR reverses encryptAESCTR.
+func decryptAESCTR(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("adapter: secure metadata ciphertext too short")
+	}
+	iv, ct := ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
+
+	out := make([]byte, len(ct))
+	cipher.NewCTR(block, iv).XORKeyStream(out, ct)
+
+	return out, nil
+}
+
+// sign computes the HMAC-SHA256 over the token's other fields, using
+// HashKeys[0].
+func (c *SecureCodec) sign(nameB64, timestamp, valueB64 string) []byte {
+	mac := hmac.New(sha256.New, c.HashKeys[0])
+	mac.Write([]byte(nameB64))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(valueB64))
+	return mac.Sum(nil)
+}
+
+// verify reports the index within HashKeys of the key that authenticates
+// the token's other fields, using constant-time comparison, or -1 if
+// none does. The index identifies which rotation epoch the token
+// belongs to, so Decode can use the BlockKeys entry from the same
+// epoch rather than guessing.
+func (c *SecureCodec) verify(nameB64, timestamp, valueB64 string, mac []byte) int {
+	for i, key := range c.HashKeys {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(nameB64))
+		h.Write([]byte{'|'})
+		h.Write([]byte(timestamp))
+		h.Write([]byte{'|'})
+		h.Write([]byte(valueB64))
+		if hmac.Equal(h.Sum(nil), mac) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Encode authenticates value (encrypting it too, if BlockKeys is
+// non-empty) and returns the '|'-joined wire token described on
+// SecureCodec. Requires at least one hash key.
+func (c *SecureCodec) Encode(value string) (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+
+	plain := []byte(value)
+	if len(c.BlockKeys) > 0 {
+		encrypted, err := encryptAESCTR(c.BlockKeys[0], plain)
+		if err != nil {
+			return "", err
+		}
+		plain = encrypted
+	}
+
+	nameB64 := base64.RawURLEncoding.EncodeToString([]byte(c.Name))
+	valueB64 := base64.RawURLEncoding.EncodeToString(plain)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	macB64 := base64.RawURLEncoding.EncodeToString(c.sign(nameB64, timestamp, valueB64))
+
+	return strings.Join([]string{nameB64, timestamp, valueB64, macB64}, "|"), nil
+}
+
+// Decode verifies and decodes a token produced by Encode, rejecting it
+// if the HMAC doesn't verify under any configured hash key, the name
+// doesn't match c.Name, or it's older than MaxAge.
+func (c *SecureCodec) Decode(token string) (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(token, "|")
+	if len(parts) != 4 {
+		return "", errors.New("adapter: malformed secure metadata token")
+	}
+	nameB64, timestamp, valueB64, macB64 := parts[0], parts[1], parts[2], parts[3]
+
+	mac, err := base64.RawURLEncoding.DecodeString(macB64)
+	if err != nil {
+		return "", errors.New("adapter: malformed secure metadata HMAC")
+	}
+	keyIndex := c.verify(nameB64, timestamp, valueB64, mac)
+	if keyIndex < 0 {
+		return "", errors.New("adapter: secure metadata HMAC verification failed")
+	}
+
+	if c.MaxAge > 0 {
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return "", errors.New("adapter: malformed secure metadata timestamp")
+		}
+		if time.Since(time.Unix(sec, 0)) > c.MaxAge {
+			return "", errors.New("adapter: secure metadata token expired")
+		}
+	}
+
+	name, err := base64.RawURLEncoding.DecodeString(nameB64)
+	if err != nil || string(name) != c.Name {
+		return "", errors.New("adapter: secure metadata name mismatch")
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(valueB64)
+	if err != nil {
+		return "", errors.New("adapter: malformed secure metadata value")
+	}
+
+	if len(c.BlockKeys) == 0 {
+		return string(value), nil
+	}
+
+	// AES-CTR decryption can't detect a wrong key, so we must use the
+	// BlockKeys entry from the same rotation epoch as the HashKeys
+	// entry that verified the HMAC, rather than trying every BlockKeys
+	// entry and trusting the first one that doesn't error.
+	plain, err := decryptAESCTR(c.BlockKeys[keyIndex], value)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// escapeMetadataSecure signs (and, if codec has block keys, encrypts)
+// value into a SecureCodec token, then percent-encodes that token the
+// same way escapeMetadata does, for use as a cookie value.
+func escapeMetadataSecure(value string, codec *SecureCodec) (string, error) {
+	token, err := codec.Encode(value)
+	if err != nil {
+		return "", err
+	}
+	return escapeMetadata(token), nil
+}
+
+// cookieMatcherForSecureMetadata produces a regular expression matching
+// the structural shape of a value produced by escapeMetadataSecure: four
+// base64url segments joined by literal '|' characters (which are cookie-
+// safe and so pass through escapeMetadata unescaped), the fourth of which
+// is a fixed-length HMAC-SHA256 digest. It lets Envoy route on the
+// presence of a well-formed secure cookie without holding the codec's
+// keys; the value is still only trustworthy once verified with Decode.
+func cookieMatcherForSecureMetadata() string {
+	macLen := base64.RawURLEncoding.EncodedLen(sha256.Size)
+	return fmt.Sprintf(`^[A-Za-z0-9_-]*\|\d+\|[A-Za-z0-9_-]*\|[A-Za-z0-9_-]{%d}$`, macLen)
+}
+
+// htmlContext identifies where an escaped metadata value will be
+// interpolated, since safe escaping differs by sink: an HTML attribute
+// value must additionally escape the quote character that delimits it,
+// which plain text content need not.
+type htmlContext int
+
+const (
+	htmlText htmlContext = iota
+	htmlAttr
+)
+
+// escapeMetadataForHTML escapes value for safe interpolation into the
+// given HTML sink context, e.g. when a Lua or transformation filter
+// echoes upstream metadata into a response body.
+func escapeMetadataForHTML(value string, ctx htmlContext) string {
+	escaper := htmlTextEscaper
+	if ctx == htmlAttr {
+		escaper = htmlAttrEscaper
+	}
+	escaped, _ := escaper.transform(value)
+	return escaped
+}
+
+// htmlMatcherForMetadata produces a string literal suitable for matching
+// a response body fragment against value as escaped for the given HTML
+// sink context by escapeMetadataForHTML. Like queryMatcherForMetadata,
+// this is always a literal: HTML entity escaping never requires regex
+// alternation the way header matching does.
+func htmlMatcherForMetadata(value string, ctx htmlContext) string {
+	return escapeMetadataForHTML(value, ctx)
+}
+
+// escapeMetadataForJSON escapes value for safe interpolation into a
+// JSON string literal, e.g. when upstream metadata is embedded in a
+// JSON response body by a transformation filter.
+func escapeMetadataForJSON(value string) string {
+	escaped, _ := jsonStringEscaper.transform(value)
+	return escaped
+}
+
+// jsonStringMatcherForMetadata produces a string literal suitable for
+// matching a response body fragment against value as escaped by
+// escapeMetadataForJSON.
+func jsonStringMatcherForMetadata(value string) string {
+	return escapeMetadataForJSON(value)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package adapter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathSegmentMatcherForMetadataLeavesSubDelimsUnescaped(t *testing.T) {
+	// pchar (https://tools.ietf.org/html/rfc3986#section-3.3) permits
+	// unreserved, sub-delims, ':', and '@' unescaped, unlike the stricter
+	// query grammar. (net/url.PathEscape is stricter than pchar here: it
+	// also escapes '!', '\'', '(', ')', '*', ',' and ';'.)
+	value := `a:b@c!d$e&f'g(h)i*j+k,l;m=n`
+	got := pathSegmentMatcherForMetadata(value)
+	if got != value {
+		t.Errorf("pathSegmentMatcherForMetadata(%q) = %q, want unescaped %q", value, got, value)
+	}
+}
+
+func TestPathSegmentMatcherForMetadataEscapesPathUnsafeBytes(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{"%", "%25"},
+		{" ", "%20"},
+		{"/", "%2f"},
+		{"?", "%3f"},
+		{"#", "%23"},
+		{"\xff", "%ff"},
+	}
+
+	for _, c := range cases {
+		got := pathSegmentMatcherForMetadata(c.value)
+		if got != c.want {
+			t.Errorf("pathSegmentMatcherForMetadata(%q) = %q, want %q", c.value, got, c.want)
+		}
+	}
+}
+
+func TestEscapeMetadataForPathSegmentMatchesPathSegmentMatcher(t *testing.T) {
+	// escapeMetadataForPathSegment is the emitter counterpart to
+	// pathSegmentMatcherForMetadata: a value it escapes must be matched
+	// by the matcher built from the same input.
+	value := `tenant-id:42,region;us-east-1 & more%`
+	escaped := escapeMetadataForPathSegment(value)
+	matcher := pathSegmentMatcherForMetadata(value)
+	if escaped != matcher {
+		t.Errorf("escapeMetadataForPathSegment(%q) = %q, want match with pathSegmentMatcherForMetadata %q", value, escaped, matcher)
+	}
+}
+
+func TestPathSegmentMatcherForMetadataLeavesCookieUnsafePcharsUnescaped(t *testing.T) {
+	// ',' and ';' are valid pchars but are cookie-unsafe, so the
+	// path-segment pathway must not delegate to escapeMetadata.
+	value := ",;"
+	if got := pathSegmentMatcherForMetadata(value); got != value {
+		t.Errorf("pathSegmentMatcherForMetadata(%q) = %q, want unescaped %q", value, got, value)
+	}
+	if got := escapeMetadata(value); got == value {
+		t.Errorf("escapeMetadata(%q) = %q, expected it to escape ',' and ';'", value, got)
+	}
+}
+
+// TestHeaderMatcherForMetadataLateRegexTrigger exercises the case
+// transform's single-pass rewrite had to get right: a regex-requiring
+// byte (';') that only shows up after a long run of bytes (periods)
+// that are safe under dynamicEscape but would need an extra backslash
+// once the mode flips to alwaysEscape.
+func TestHeaderMatcherForMetadataLateRegexTrigger(t *testing.T) {
+	value := strings.Repeat(".", 5) + ";"
+	got, isRegex := headerMatcherForMetadata(value)
+	if !isRegex {
+		t.Fatalf("headerMatcherForMetadata(%q) isRegex = false, want true", value)
+	}
+	want := strings.Repeat(`\.`, 5) + `(%3b|;)`
+	if got != want {
+		t.Errorf("headerMatcherForMetadata(%q) = %q, want %q", value, got, want)
+	}
+}
+
+// metadataValueWithLateRegexTrigger builds a value of length n that is
+// entirely header/cookie/query/regex-safe except for a single trailing
+// ';' (cookie-unsafe, forcing a regex match for the header matcher).
+// Placing the trigger last is the worst case for a restart-based
+// transform: the entire string must be scanned once before the need
+// for a regex is discovered.
+func metadataValueWithLateRegexTrigger(n int) string {
+	return strings.Repeat("a", n-1) + ";"
+}
+
+func benchmarkMatcherForMetadata(b *testing.B, size int, matcher func(string)) {
+	value := metadataValueWithLateRegexTrigger(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher(value)
+	}
+}
+
+func BenchmarkHeaderMatcherForMetadata16B(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 16, func(v string) { headerMatcherForMetadata(v) })
+}
+
+func BenchmarkHeaderMatcherForMetadata256B(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 256, func(v string) { headerMatcherForMetadata(v) })
+}
+
+func BenchmarkHeaderMatcherForMetadata4KB(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 4096, func(v string) { headerMatcherForMetadata(v) })
+}
+
+func BenchmarkCookieMatcherForMetadata16B(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 16, func(v string) { cookieMatcherForMetadata(v) })
+}
+
+func BenchmarkCookieMatcherForMetadata256B(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 256, func(v string) { cookieMatcherForMetadata(v) })
+}
+
+func BenchmarkCookieMatcherForMetadata4KB(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 4096, func(v string) { cookieMatcherForMetadata(v) })
+}
+
+func BenchmarkQueryMatcherForMetadata16B(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 16, func(v string) { queryMatcherForMetadata(v) })
+}
+
+func BenchmarkQueryMatcherForMetadata256B(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 256, func(v string) { queryMatcherForMetadata(v) })
+}
+
+func BenchmarkQueryMatcherForMetadata4KB(b *testing.B) {
+	benchmarkMatcherForMetadata(b, 4096, func(v string) { queryMatcherForMetadata(v) })
+}